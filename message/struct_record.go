@@ -2,7 +2,6 @@ package message
 
 import (
 	"reflect"
-	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -13,25 +12,61 @@ import (
 // to the database column. the GetKeys() call of this returns the 'db' tag values.
 // You should always use the NewStructRecord constructor to create this.
 type StructRecord struct {
-	tagName    string
-	record     interface{} // record holds the struct to do the tag lookup on
-	tags       []string
-	tagsToName map[string]string
+	record interface{} // record holds the struct (or pointer to struct) to do the tag lookup on
+	schema *structSchema
 }
 
 // ErrNotAStruct is for when the provided arg is not a struct
 var ErrNotAStruct = errors.New("not a struct")
 
-// NewStructRecord createa a new StructRecord. The tagName arg
-// is optional and will be used instead of the default field name.
-// While the tagName arg is a slice, only the [0] value is used.
-// The value of the tag for a given field is ignore if it is "" or "-".
-// and will be skipped. If the tag value has a "," in it, the part
-// before comma is used as the tag value. This allows for values like "id,omitempty"
-func NewStructRecord(strct interface{}, tagName ...string) (StructRecord, error) {
-	tag := ""
-	if len(tagName) > 0 {
-		tag = tagName[0]
+// ErrNotSettable is returned by Set/SetVals when the wrapped struct
+// was not given to NewStructRecord as a pointer, or the target field
+// cannot be set (e.g. a nil embedded pointer lies on its path).
+// Unexported fields have no key, so setting one reports an unknown key.
+var ErrNotSettable = errors.New("not settable")
+
+// Option configures a StructRecord built by NewStructRecord.
+type Option func(*structOptions)
+
+type structOptions struct {
+	tags    []string // ordered fallback chain of tag names to look up, e.g. "db", "json"
+	flatten bool
+}
+
+// WithTag sets the struct tag(s) to look up instead of the field name
+// when building keys, e.g. WithTag("db"). Pass more than one tag name,
+// e.g. WithTag("db", "json"), to try them in order for each field: the
+// first one present with a value is used, so a single struct can drive
+// both a SQL sink and a JSON sink without duplicate tags. A tag value
+// of "-" explicitly excludes the field; if none of the tags are
+// present on a field at all, its Go field name is used, matching the
+// no-tag default. If the tag value has a "," in it, the part before
+// the comma is used, which allows for values like "id,omitempty".
+func WithTag(tags ...string) Option {
+	return func(o *structOptions) { o.tags = append(o.tags, tags...) }
+}
+
+// WithFlatten recurses into nested struct fields, exposing their
+// fields as keys on the parent StructRecord. Embedded (anonymous)
+// struct fields are always promoted using the child's own key,
+// matching Go's field promotion rules; WithFlatten additionally
+// promotes named nested struct fields, prefixing their keys with the
+// parent field's own key, e.g. "Body.ID" for the ID field of a field
+// "Body Body" when no tag is used.
+func WithFlatten() Option {
+	return func(o *structOptions) { o.flatten = true }
+}
+
+// NewStructRecord creates a new StructRecord. By default keys are the
+// field names of strct; use WithTag to look up a struct tag instead,
+// and WithFlatten to promote nested struct fields onto the parent.
+//
+// Pass a pointer to the struct if you intend to use Set/SetVals to
+// write values back into it.
+func NewStructRecord(strct interface{}, opts ...Option) (StructRecord, error) {
+	var so structOptions
+	for _, opt := range opts {
+		opt(&so)
 	}
 
 	// ensure that it is a struct we are working with
@@ -43,34 +78,12 @@ func NewStructRecord(strct interface{}, tagName ...string) (StructRecord, error)
 		return StructRecord{}, ErrNotAStruct
 	}
 
-	// extract the tags
-	tags := []string{}
-	tagsToName := map[string]string{}
-
-	for _, sf := range reflect.VisibleFields(t) {
-		if sf.IsExported() && !sf.Anonymous {
-			tags = append(tags, extract(sf, tag, tagsToName)...)
-		}
+	schema, err := schemaFor(t, so)
+	if err != nil {
+		return StructRecord{}, err
 	}
 
-	rec := StructRecord{tagName: tag, record: strct, tags: tags, tagsToName: tagsToName}
-	return rec, nil
-}
-
-func extract(f reflect.StructField, tag string, tagsToName map[string]string) []string {
-	tags := []string{}
-	tagVal := f.Name
-	if tag != "" {
-		tagVal = strings.Split(f.Tag.Get(tag), ",")[0]
-		if tagVal == "" || tagVal == "-" {
-			// don't add if there was not tag value for a specified tag
-			return tags
-		}
-	}
-	tags = append(tags, tagVal)
-	tagsToName[tagVal] = f.Name
-
-	return tags
+	return StructRecord{record: strct, schema: schema}, nil
 }
 
 // In implements the Inner interface
@@ -81,27 +94,130 @@ func (sr StructRecord) In() interface{} {
 
 // Get implements the Record interface
 func (sr StructRecord) Get(key string) (interface{}, bool) {
-	if name, ok := sr.tagsToName[key]; ok {
-		r := reflect.ValueOf(sr.record)
-		return reflect.Indirect(r).FieldByName(name).Interface(), true
+	meta, ok := sr.schema.index[key]
+	if !ok {
+		return nil, false
 	}
-	return nil, false
+	r := reflect.Indirect(reflect.ValueOf(sr.record))
+	fv, err := r.FieldByIndexErr(meta.index)
+	if err != nil {
+		// an embedded pointer somewhere along the path is nil
+		return nil, false
+	}
+	return fv.Interface(), true
 }
 
 // GetKeys implements the Record interface
-func (sr StructRecord) GetKeys() []string { return sr.tags }
+func (sr StructRecord) GetKeys() []string { return sr.schema.tags }
+
+// GetKeyVals returns the same keys as GetKeys and values as GetVals,
+// except that keys tagged with "omitempty" are left out whenever their
+// current value is the zero value for their type, and a field behind
+// a nil embedded pointer is given its type's zero value where GetVals
+// gives nil. The two returned
+// slices always stay in lockstep, so callers writing to SQL/JSON sinks
+// don't have to reconcile mismatched keys and values.
+func (sr StructRecord) GetKeyVals() ([]string, []interface{}) {
+	r := reflect.Indirect(reflect.ValueOf(sr.record))
+
+	keys := make([]string, 0, len(sr.schema.tags))
+	vals := make([]interface{}, 0, len(sr.schema.tags))
+	for _, key := range sr.schema.tags {
+		meta := sr.schema.index[key]
+		fv, err := r.FieldByIndexErr(meta.index)
+		if err != nil {
+			// an embedded pointer somewhere along the path is nil;
+			// treat it like any other zero value
+			fv = reflect.Zero(meta.typ)
+		}
+		if meta.omitempty && reflect.DeepEqual(fv.Interface(), reflect.Zero(meta.typ).Interface()) {
+			continue
+		}
+		keys = append(keys, key)
+		vals = append(vals, fv.Interface())
+	}
+	return keys, vals
+}
+
+// Set writes val into the field of the wrapped struct that corresponds
+// to key. The StructRecord must have been created with a pointer to the
+// struct (so the field is addressable), and val must be assignable or
+// convertible to the field's type. Conversions between a string kind
+// and a numeric kind are rejected even where Go allows them.
+func (sr StructRecord) Set(key string, val interface{}) error {
+	meta, ok := sr.schema.index[key]
+	if !ok {
+		return errors.Errorf("unknown key %q", key)
+	}
+
+	r := reflect.ValueOf(sr.record)
+	if r.Kind() != reflect.Ptr {
+		return errors.Wrapf(ErrNotSettable, "StructRecord must wrap a pointer to set %q", key)
+	}
+
+	fv, err := r.Elem().FieldByIndexErr(meta.index)
+	if err != nil {
+		// an embedded pointer somewhere along the path is nil
+		return errors.Wrapf(ErrNotSettable, "field for key %q: %s", key, err)
+	}
+	if !fv.CanSet() {
+		return errors.Wrapf(ErrNotSettable, "field for key %q", key)
+	}
+
+	vv := reflect.ValueOf(val)
+	if !vv.IsValid() || !vv.Type().ConvertibleTo(fv.Type()) {
+		return errors.Errorf("value of type %T is not assignable to key %q of type %s", val, key, fv.Type())
+	}
+	if isStringNumericMismatch(vv.Kind(), fv.Kind()) {
+		return errors.Errorf("refusing to convert between string and numeric kinds for key %q (%s -> %s)", key, vv.Type(), fv.Type())
+	}
+
+	fv.Set(vv.Convert(fv.Type()))
+	return nil
+}
+
+// isStringNumericMismatch reports whether converting between a and b
+// pairs a string kind with a numeric kind. Converting an integer to a
+// string goes through Go's rune conversion rules, e.g. int(65) -> "A";
+// reflect.Type.ConvertibleTo allows this, but it's almost never what
+// a caller setting a struct field actually wants.
+func isStringNumericMismatch(a, b reflect.Kind) bool {
+	return (a == reflect.String && isNumericKind(b)) || (b == reflect.String && isNumericKind(a))
+}
+
+func isNumericKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetVals writes vals into the wrapped struct in the same order as
+// GetKeys()/GetVals(), one value per key.
+func (sr StructRecord) SetVals(vals []interface{}) error {
+	if len(vals) != len(sr.schema.tags) {
+		return errors.Errorf("expected %d values, got %d", len(sr.schema.tags), len(vals))
+	}
+	for i, key := range sr.schema.tags {
+		if err := sr.Set(key, vals[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
 // GetVals implements the Record interface
 func (sr StructRecord) GetVals() []interface{} {
-	vals := []interface{}{}
-	for _, key := range sr.tags {
-		if val, ok := sr.Get(key); ok {
-			vals = append(vals, val)
-		} else {
-			// not ok so for some reason
-			// this should never happen but if it does, return nil
-			return nil
-		}
+	vals := make([]interface{}, 0, len(sr.schema.tags))
+	for _, key := range sr.schema.tags {
+		// val is nil, ok=false when an embedded pointer along the path
+		// is nil; keep the slot so vals stays aligned with GetKeys().
+		val, _ := sr.Get(key)
+		vals = append(vals, val)
 	}
 	return vals
 }
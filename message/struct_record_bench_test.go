@@ -0,0 +1,55 @@
+package message
+
+import "testing"
+
+type benchStruct20 struct {
+	F1  string
+	F2  string
+	F3  string
+	F4  string
+	F5  string
+	F6  int
+	F7  int
+	F8  int
+	F9  int
+	F10 int
+	F11 bool
+	F12 bool
+	F13 bool
+	F14 bool
+	F15 bool
+	F16 float64
+	F17 float64
+	F18 float64
+	F19 float64
+	F20 float64
+}
+
+// BenchmarkNewStructRecord measures the cost of constructing a
+// StructRecord for a 20-field struct, which after caching the
+// reflect.VisibleFields/tag walk in schemaFor should be dominated
+// by the allocation of the StructRecord itself rather than repeated
+// reflection work.
+func BenchmarkNewStructRecord(b *testing.B) {
+	s := benchStruct20{F1: "a", F2: "b", F6: 1, F11: true, F16: 1.5}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewStructRecord(s); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStructRecordGetVals(b *testing.B) {
+	s := benchStruct20{F1: "a", F2: "b", F6: 1, F11: true, F16: 1.5}
+	rec, err := NewStructRecord(s)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec.GetVals()
+	}
+}
@@ -0,0 +1,44 @@
+package message
+
+import "github.com/pkg/errors"
+
+// ErrUnknownMapKey is returned by NewStructRecordFromMap when the map
+// has a key that doesn't correspond to any field of the destination
+// struct.
+var ErrUnknownMapKey = errors.New("unknown map key")
+
+// ToMap returns the StructRecord's keys and values as a map, honoring
+// the same omitempty/"-" rules as GetKeyVals. This is a convenient
+// bridge to a MapRecord at a stage boundary, e.g. a typed transform
+// feeding a JSON or SQL sink that expects a map.
+func (sr StructRecord) ToMap() map[string]interface{} {
+	keys, vals := sr.GetKeyVals()
+	m := make(map[string]interface{}, len(keys))
+	for i, key := range keys {
+		m[key] = vals[i]
+	}
+	return m
+}
+
+// NewStructRecordFromMap populates dst, a pointer to a struct, by
+// looking up each of its keys (resolved the same way as
+// NewStructRecord, with the same opts) in m and converting the value
+// to the field's type. It returns ErrUnknownMapKey if m has a key that
+// doesn't map to any field of dst, or a conversion error from Set if a
+// value isn't assignable to its field.
+func NewStructRecordFromMap(dst interface{}, m map[string]interface{}, opts ...Option) error {
+	sr, err := NewStructRecord(dst, opts...)
+	if err != nil {
+		return err
+	}
+
+	for key, val := range m {
+		if _, ok := sr.schema.index[key]; !ok {
+			return errors.Wrapf(ErrUnknownMapKey, "key %q", key)
+		}
+		if err := sr.Set(key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
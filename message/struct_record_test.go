@@ -0,0 +1,361 @@
+package message
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStructRecordSet(t *testing.T) {
+	type target struct {
+		Name string `db:"name"`
+		Age  int64  `db:"age"`
+	}
+
+	t.Run("requires a pointer", func(t *testing.T) {
+		rec, err := NewStructRecord(target{}, WithTag("db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rec.Set("name", "bob"); !errors.Is(err, ErrNotSettable) {
+			t.Fatalf("expected ErrNotSettable, got %v", err)
+		}
+	})
+
+	t.Run("sets and converts assignable types", func(t *testing.T) {
+		v := &target{}
+		rec, err := NewStructRecord(v, WithTag("db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rec.Set("name", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		if err := rec.Set("age", int(42)); err != nil { // int -> int64
+			t.Fatal(err)
+		}
+		if v.Name != "bob" || v.Age != 42 {
+			t.Fatalf("got %+v", v)
+		}
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		rec, err := NewStructRecord(&target{}, WithTag("db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rec.Set("nope", "x"); err == nil {
+			t.Fatal("expected an error for an unknown key")
+		}
+	})
+
+	t.Run("unconvertible value", func(t *testing.T) {
+		rec, err := NewStructRecord(&target{}, WithTag("db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rec.Set("age", "not-a-number"); err == nil {
+			t.Fatal("expected an error for an unconvertible value")
+		}
+	})
+
+	t.Run("rejects numeric-to-string rune conversion", func(t *testing.T) {
+		rec, err := NewStructRecord(&target{}, WithTag("db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rec.Set("name", 65); err == nil {
+			t.Fatal("expected an error instead of silently rune-converting 65 into \"A\"")
+		}
+	})
+}
+
+func TestStructRecordSetVals(t *testing.T) {
+	v := &struct {
+		Name string `db:"name"`
+		Age  int64  `db:"age"`
+	}{}
+
+	rec, err := NewStructRecord(v, WithTag("db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rec.SetVals([]interface{}{"bob", int64(42)}); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "bob" || v.Age != 42 {
+		t.Fatalf("got %+v", v)
+	}
+
+	if err := rec.SetVals([]interface{}{"only one"}); err == nil {
+		t.Fatal("expected an error on a length mismatch")
+	}
+}
+
+func TestStructRecordEmbeddedPromotion(t *testing.T) {
+	type Inner struct {
+		ID string
+	}
+	type Outer struct {
+		Inner
+		Name string
+	}
+
+	o := Outer{Inner: Inner{ID: "i1"}, Name: "o1"}
+	rec, err := NewStructRecord(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, ok := rec.Get("ID")
+	if !ok || id != "i1" {
+		t.Fatalf("expected promoted ID %q, got %v, %v", "i1", id, ok)
+	}
+	name, ok := rec.Get("Name")
+	if !ok || name != "o1" {
+		t.Fatalf("expected Name %q, got %v, %v", "o1", name, ok)
+	}
+}
+
+func TestStructRecordEmbeddedShadowing(t *testing.T) {
+	type Inner struct {
+		Name string
+	}
+	type Outer struct {
+		Inner
+		Name string
+	}
+
+	o := Outer{Inner: Inner{Name: "inner"}, Name: "outer"}
+	rec, err := NewStructRecord(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := rec.GetKeys()
+	count := 0
+	for _, k := range keys {
+		if k == "Name" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatalf("expected exactly one promoted %q key, got %d in %v", "Name", count, keys)
+	}
+
+	name, ok := rec.Get("Name")
+	if !ok || name != "outer" {
+		t.Fatalf("expected the shallower field to win with %q, got %v, %v", "outer", name, ok)
+	}
+}
+
+func TestStructRecordNilEmbeddedPointer(t *testing.T) {
+	type Inner struct {
+		Name string
+	}
+	type Outer struct {
+		*Inner
+	}
+
+	o := &Outer{} // Inner is nil
+	rec, err := NewStructRecord(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := rec.Get("Name"); ok {
+		t.Fatal("expected Get through a nil embedded pointer to report not-ok, not panic")
+	}
+
+	vals := rec.GetVals() // must not panic
+	if len(vals) != len(rec.GetKeys()) {
+		t.Fatalf("GetVals length %d should match GetKeys length %d", len(vals), len(rec.GetKeys()))
+	}
+
+	if err := rec.Set("Name", "x"); !errors.Is(err, ErrNotSettable) {
+		t.Fatalf("expected ErrNotSettable through a nil embedded pointer, got %v", err)
+	}
+}
+
+func TestStructRecordFlattenNestedDottedKeys(t *testing.T) {
+	type Body struct {
+		Text string `db:"text"`
+	}
+	type Envelope struct {
+		Payload Body `db:"payload"`
+	}
+
+	e := Envelope{Payload: Body{Text: "hi"}}
+
+	t.Run("without flatten the nested struct is a leaf value", func(t *testing.T) {
+		rec, err := NewStructRecord(e, WithTag("db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, ok := rec.Get("payload")
+		if !ok {
+			t.Fatal("expected a payload key")
+		}
+		if _, isBody := val.(Body); !isBody {
+			t.Fatalf("expected the raw nested struct, got %T", val)
+		}
+	})
+
+	t.Run("with flatten the nested fields are promoted as dotted keys", func(t *testing.T) {
+		rec, err := NewStructRecord(e, WithTag("db"), WithFlatten())
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, ok := rec.Get("payload.text")
+		if !ok || val != "hi" {
+			t.Fatalf("expected payload.text=%q, got %v, %v", "hi", val, ok)
+		}
+	})
+}
+
+func TestStructRecordGetKeyValsOmitempty(t *testing.T) {
+	type target struct {
+		ID   string `db:"id"`
+		Note string `db:"note,omitempty"`
+	}
+
+	t.Run("zero value is omitted", func(t *testing.T) {
+		rec, err := NewStructRecord(target{ID: "1"}, WithTag("db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, vals := rec.GetKeyVals()
+		for _, k := range keys {
+			if k == "note" {
+				t.Fatalf("expected omitempty to drop a zero-value note, got keys=%v vals=%v", keys, vals)
+			}
+		}
+		if len(keys) != len(vals) {
+			t.Fatalf("keys/vals length mismatch: %d vs %d", len(keys), len(vals))
+		}
+	})
+
+	t.Run("non-zero value is kept", func(t *testing.T) {
+		rec, err := NewStructRecord(target{ID: "1", Note: "hi"}, WithTag("db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, vals := rec.GetKeyVals()
+		found := false
+		for i, k := range keys {
+			if k == "note" {
+				found = true
+				if vals[i] != "hi" {
+					t.Fatalf("expected note=%q, got %v", "hi", vals[i])
+				}
+			}
+		}
+		if !found {
+			t.Fatalf("expected a non-zero note to be kept, got keys=%v", keys)
+		}
+	})
+}
+
+func TestStructRecordToMap(t *testing.T) {
+	type target struct {
+		ID  string `db:"id"`
+		Age int64  `db:"age,omitempty"`
+	}
+
+	rec, err := NewStructRecord(target{ID: "1"}, WithTag("db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := rec.ToMap()
+	if m["id"] != "1" {
+		t.Fatalf("expected id=1, got %v", m["id"])
+	}
+	if _, ok := m["age"]; ok {
+		t.Fatalf("expected omitempty age to be left out of the map, got %v", m)
+	}
+}
+
+func TestNewStructRecordFromMap(t *testing.T) {
+	t.Run("round trips into the struct", func(t *testing.T) {
+		type target struct {
+			ID  string `db:"id"`
+			Age int64  `db:"age"`
+		}
+
+		dst := &target{}
+		m := map[string]interface{}{"id": "1", "age": int64(42)}
+		if err := NewStructRecordFromMap(dst, m, WithTag("db")); err != nil {
+			t.Fatal(err)
+		}
+		if dst.ID != "1" || dst.Age != 42 {
+			t.Fatalf("got %+v", dst)
+		}
+	})
+
+	t.Run("rejects an unknown key", func(t *testing.T) {
+		type target struct {
+			ID string `db:"id"`
+		}
+
+		dst := &target{}
+		m := map[string]interface{}{"id": "1", "nope": "x"}
+		err := NewStructRecordFromMap(dst, m, WithTag("db"))
+		if !errors.Is(err, ErrUnknownMapKey) {
+			t.Fatalf("expected ErrUnknownMapKey, got %v", err)
+		}
+	})
+}
+
+func TestStructRecordTagFallbackChain(t *testing.T) {
+	type target struct {
+		// ID has no db tag, so it falls back to the json tag.
+		ID string `json:"id"`
+		// Name has both tags; the db tag wins over json.
+		Name string `db:"name" json:"full"`
+		// Skip is "-" in db, which excludes it regardless of json.
+		Skip string `db:"-" json:"skip_json"`
+		// NoTags has neither tag, so it falls back to the field name.
+		NoTags string
+	}
+
+	rec, err := NewStructRecord(target{}, WithTag("db", "json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := rec.GetKeys()
+	want := map[string]bool{"id": true, "name": true, "NoTags": true}
+	got := map[string]bool{}
+	for _, k := range keys {
+		got[k] = true
+	}
+	for k := range want {
+		if !got[k] {
+			t.Fatalf("expected key %q in %v", k, keys)
+		}
+	}
+	for _, excluded := range []string{"full", "skip_json", "Skip", "-"} {
+		if got[excluded] {
+			t.Fatalf("did not expect key %q in %v", excluded, keys)
+		}
+	}
+}
+
+func TestStructRecordFlattenDuplicateKey(t *testing.T) {
+	type A struct {
+		ID string `db:"x"`
+	}
+	type B struct {
+		ID string `db:"x"`
+	}
+	type Envelope struct {
+		First  A `db:"first"`
+		Second B `db:"first"`
+	}
+
+	_, err := NewStructRecord(Envelope{}, WithTag("db"), WithFlatten())
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("expected ErrDuplicateKey for two fields flattened to the same key, got %v", err)
+	}
+}
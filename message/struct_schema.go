@@ -0,0 +1,186 @@
+package message
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fieldMeta describes how a single key maps back onto the wrapped
+// struct: the field-index path for FieldByIndex, its type, and the
+// tag options (omitempty, readonly) that were parsed alongside its
+// name.
+type fieldMeta struct {
+	index     []int
+	typ       reflect.Type
+	omitempty bool
+	readonly  bool // reserved: not yet enforced by Set/SetVals
+}
+
+// structSchema holds the field/tag layout for a given (reflect.Type,
+// structOptions) pair. It is computed once per type and cached, since
+// walking the struct's fields and parsing their tags is the dominant
+// cost of building a StructRecord for every record flowing through a
+// pipe.
+type structSchema struct {
+	tags  []string
+	index map[string]fieldMeta // key -> field metadata
+}
+
+type schemaCacheKey struct {
+	typ     reflect.Type
+	tags    string // opts.tags joined, since a slice can't be a map key
+	flatten bool
+}
+
+// ErrDuplicateKey is returned by NewStructRecord when two fields
+// resolve to the same key, e.g. two WithFlatten-ed nested struct
+// fields both tagged with the same name.
+var ErrDuplicateKey = errors.New("duplicate key")
+
+type schemaCacheEntry struct {
+	schema *structSchema
+	err    error
+}
+
+var schemaCache sync.Map // map[schemaCacheKey]schemaCacheEntry
+
+// timeType is never recursed into even when flattening, since it is
+// itself a struct but is always meant to be treated as a leaf value.
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor returns the cached structSchema for t/opts, building and
+// storing it on first use. It returns ErrDuplicateKey if two fields of
+// t resolve to the same key.
+func schemaFor(t reflect.Type, opts structOptions) (*structSchema, error) {
+	key := schemaCacheKey{typ: t, tags: strings.Join(opts.tags, "\x00"), flatten: opts.flatten}
+	if cached, ok := schemaCache.Load(key); ok {
+		entry := cached.(schemaCacheEntry)
+		return entry.schema, entry.err
+	}
+
+	schema := &structSchema{tags: []string{}, index: map[string]fieldMeta{}}
+	err := walkFields(t, nil, "", opts, schema)
+
+	actual, _ := schemaCache.LoadOrStore(key, schemaCacheEntry{schema: schema, err: err})
+	entry := actual.(schemaCacheEntry)
+	return entry.schema, entry.err
+}
+
+// walkFields appends an entry to schema for every leaf field of t.
+// Embedded struct fields are promoted using reflect.VisibleFields,
+// which applies Go's own shadowing/ambiguity rules (the shallowest
+// field wins, and fields shadowed or made ambiguous by depth are
+// dropped), so a name colliding with a promoted field never produces
+// a duplicate key. When opts.flatten is set, named nested struct
+// fields are additionally recursed into by this function, dotting
+// their keys onto the parent's; it is an error (ErrDuplicateKey) for
+// two such fields to resolve to the same key. indexPrefix is the
+// field-index path from the record root down to t, and keyPrefix is
+// the dotted key path to prepend to keys found while walking named
+// nested fields.
+func walkFields(t reflect.Type, indexPrefix []int, keyPrefix string, opts structOptions, schema *structSchema) error {
+	for _, sf := range reflect.VisibleFields(t) {
+		if !sf.IsExported() || sf.Anonymous {
+			// sf.Anonymous here is the embedded field itself; its
+			// promoted members already appear as separate entries
+			// from reflect.VisibleFields, so there's nothing left to
+			// do for the embedded field itself.
+			continue
+		}
+
+		index := make([]int, 0, len(indexPrefix)+len(sf.Index))
+		index = append(index, indexPrefix...)
+		index = append(index, sf.Index...)
+
+		tagVal, tagOpts, ok := resolveTag(sf, opts.tags)
+		if !ok {
+			continue
+		}
+		key := tagVal
+		if keyPrefix != "" {
+			key = keyPrefix + "." + tagVal
+		}
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if opts.flatten && ft.Kind() == reflect.Struct && ft != timeType {
+			if err := walkFields(ft, index, key, opts, schema); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, exists := schema.index[key]; exists {
+			return errors.Wrapf(ErrDuplicateKey, "key %q", key)
+		}
+
+		schema.tags = append(schema.tags, key)
+		schema.index[key] = fieldMeta{
+			index:     index,
+			typ:       sf.Type,
+			omitempty: tagOpts.omitempty,
+			readonly:  tagOpts.readonly,
+		}
+	}
+	return nil
+}
+
+// tagOptions holds the trailing, comma-separated options on a struct
+// tag, e.g. the "omitempty" in `db:"id,omitempty"`.
+type tagOptions struct {
+	omitempty bool
+	readonly  bool
+}
+
+// resolveTag returns the key to use for sf and its parsed tag options,
+// or ok=false if the field should be skipped entirely.
+//
+// tags is an ordered fallback chain: each is tried in turn, and the
+// first one present on sf with a non-empty value wins. A tag value of
+// "-" explicitly excludes the field, regardless of what a later tag in
+// the chain would have resolved to. If none of the tags are present on
+// sf at all, its Go field name is used, matching the no-tag default.
+func resolveTag(sf reflect.StructField, tags []string) (string, tagOptions, bool) {
+	if len(tags) == 0 {
+		return sf.Name, tagOptions{}, true
+	}
+
+	for _, tag := range tags {
+		raw, present := sf.Tag.Lookup(tag)
+		if !present {
+			continue
+		}
+
+		parts := strings.Split(raw, ",")
+		tagVal := parts[0]
+		if tagVal == "-" {
+			return "", tagOptions{}, false
+		}
+		if tagVal == "" {
+			continue
+		}
+
+		return tagVal, parseTagOptions(parts[1:]), true
+	}
+
+	return sf.Name, tagOptions{}, true
+}
+
+func parseTagOptions(opts []string) tagOptions {
+	var to tagOptions
+	for _, opt := range opts {
+		switch opt {
+		case "omitempty":
+			to.omitempty = true
+		case "readonly":
+			to.readonly = true
+		}
+	}
+	return to
+}